@@ -0,0 +1,109 @@
+// Package sanitize shapes a SQL statement and its bound variables before
+// they are attached to a span, shared by the otgorm, otgormv2 and
+// ototelgorm backends so the three keep the same redaction/truncation
+// semantics.
+package sanitize
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Config controls how a SQL statement and its bound variables are rendered
+// before being recorded on a span.
+type Config struct {
+	// StrLen truncates string vars longer than StrLen runes. StrLen <= 0
+	// means no truncation.
+	StrLen int
+	// ByteSliceLen truncates []byte vars longer than ByteSliceLen bytes.
+	// ByteSliceLen <= 0 means no truncation.
+	ByteSliceLen int
+	// Normalize replaces literal values in the SQL statement with "?" so
+	// that high-cardinality queries share a single recorded statement
+	// instead of one per distinct literal.
+	Normalize bool
+	// RedactTables lists table names whose bound vars are redacted instead
+	// of serialized.
+	RedactTables []string
+	// RedactColumns lists column names whose bound vars are redacted
+	// instead of serialized. Matching is a best-effort substring match
+	// against the SQL text, since SQLVars aren't mapped back to column
+	// names across gorm versions.
+	RedactColumns []string
+	// SanitizeFunc, when set, takes over sanitizing sql/vars entirely and
+	// overrides StrLen, ByteSliceLen, Normalize, RedactTables and
+	// RedactColumns.
+	SanitizeFunc func(sql string, vars []interface{}) (string, []interface{})
+}
+
+const redacted = "***"
+
+var literalPattern = regexp.MustCompile(`'(?:[^']|'')*'|\b\d+(?:\.\d+)?\b`)
+
+// Statement sanitizes sql/vars bound against table according to conf.
+func Statement(conf Config, table, sql string, vars []interface{}) (string, []interface{}) {
+	if conf.SanitizeFunc != nil {
+		return conf.SanitizeFunc(sql, vars)
+	}
+	if containsString(conf.RedactTables, table) || containsSubstring(sql, conf.RedactColumns) {
+		vars = redactVars(vars)
+	} else {
+		vars = truncateVars(conf, vars)
+	}
+	if conf.Normalize {
+		sql = Normalize(sql)
+	}
+	return sql, vars
+}
+
+// Normalize replaces literal values in sql with "?" so that high-cardinality
+// queries share a single recorded statement instead of one per distinct
+// literal.
+func Normalize(sql string) string {
+	return literalPattern.ReplaceAllString(sql, "?")
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsSubstring(sql string, substrings []string) bool {
+	for _, s := range substrings {
+		if strings.Contains(sql, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactVars(vars []interface{}) []interface{} {
+	redactedVars := make([]interface{}, len(vars))
+	for i := range redactedVars {
+		redactedVars[i] = redacted
+	}
+	return redactedVars
+}
+
+func truncateVars(conf Config, vars []interface{}) []interface{} {
+	truncated := make([]interface{}, len(vars))
+	copy(truncated, vars)
+	for i, v := range truncated {
+		switch val := v.(type) {
+		case string:
+			if conf.StrLen > 0 && utf8.RuneCountInString(val) > conf.StrLen {
+				truncated[i] = string([]rune(val)[:conf.StrLen])
+			}
+		case []byte:
+			if conf.ByteSliceLen > 0 && len(val) > conf.ByteSliceLen {
+				truncated[i] = val[:conf.ByteSliceLen]
+			}
+		}
+	}
+	return truncated
+}
@@ -0,0 +1,75 @@
+package sanitize
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatement(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     Config
+		table    string
+		sql      string
+		vars     []interface{}
+		wantSQL  string
+		wantVars []interface{}
+	}{
+		{
+			name:     "normalize only leaves vars untouched",
+			conf:     Config{Normalize: true},
+			table:    "users",
+			sql:      "SELECT * FROM users WHERE id = 1",
+			vars:     []interface{}{"alice"},
+			wantSQL:  "SELECT * FROM users WHERE id = ?",
+			wantVars: []interface{}{"alice"},
+		},
+		{
+			name:     "redact tables only leaves sql untouched",
+			conf:     Config{RedactTables: []string{"users"}},
+			table:    "users",
+			sql:      "SELECT * FROM users WHERE id = 1",
+			vars:     []interface{}{"alice"},
+			wantSQL:  "SELECT * FROM users WHERE id = 1",
+			wantVars: []interface{}{redacted},
+		},
+		{
+			name:     "StrLen zero value does not truncate",
+			conf:     Config{},
+			table:    "users",
+			sql:      "SELECT * FROM users WHERE name = ?",
+			vars:     []interface{}{"alice"},
+			wantSQL:  "SELECT * FROM users WHERE name = ?",
+			wantVars: []interface{}{"alice"},
+		},
+		{
+			name:     "StrLen truncates when positive",
+			conf:     Config{StrLen: 3},
+			table:    "users",
+			sql:      "SELECT * FROM users WHERE name = ?",
+			vars:     []interface{}{"alice"},
+			wantSQL:  "SELECT * FROM users WHERE name = ?",
+			wantVars: []interface{}{"ali"},
+		},
+		{
+			name:     "ByteSliceLen zero value does not truncate",
+			conf:     Config{},
+			table:    "users",
+			sql:      "SELECT * FROM users WHERE blob = ?",
+			vars:     []interface{}{[]byte("alice")},
+			wantSQL:  "SELECT * FROM users WHERE blob = ?",
+			wantVars: []interface{}{[]byte("alice")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotSQL, gotVars := Statement(tt.conf, tt.table, tt.sql, tt.vars)
+			if gotSQL != tt.wantSQL {
+				t.Errorf("Statement() sql = %q, want %q", gotSQL, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(gotVars, tt.wantVars) {
+				t.Errorf("Statement() vars = %#v, want %#v", gotVars, tt.wantVars)
+			}
+		})
+	}
+}
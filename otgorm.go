@@ -4,26 +4,101 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"strings"
-	"unicode/utf8"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	"github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/yangxikun/opentracing-gorm/internal/sanitize"
 )
 
 const (
-	parentSpanGormKey        = "opentracingParentSpan"
-	spanGormKey              = "opentracingSpan"
-	sqlVarsTruncationGormKey = "opentracingSqlVarsTruncation"
+	parentSpanGormKey      = "opentracingParentSpan"
+	spanGormKey            = "opentracingSpan"
+	statementConfigGormKey = "opentracingStatementConfig"
+	traceConfigGormKey     = "opentracingTraceConfig"
+	startTimeGormKey       = "opentracingStartTime"
 )
 
+// TraceConfig bounds tracing overhead on high-QPS paths by only emitting a
+// span for statements that are slow, sampled, or (optionally) errored.
+// Without a TraceConfig, every statement is traced, matching prior behavior.
+//
+// Enabling TraceConfig defers span creation from before() to after(), once
+// the statement's duration and error are known, so no span exists while the
+// statement runs. With or without a TraceConfig, this package keeps spans in
+// Scope settings only and passes no span-carrying context to the driver
+// call, so driver-level instrumentation (sqlcommenter, pgx tracing,
+// dd-trace-go's SQL driver, etc.) does not see the span as its parent.
+type TraceConfig struct {
+	// SlowQueryThreshold, if positive, always traces statements that take at
+	// least this long.
+	SlowQueryThreshold time.Duration
+	// SampleRate, in [0, 1], is the fraction of statements traced regardless
+	// of duration.
+	SampleRate float64
+	// AlwaysTraceErrors always traces statements that returned an error.
+	AlwaysTraceErrors bool
+}
+
+// SetTraceConfig sets the TraceConfig used to decide whether to emit a span
+// for a statement, returns cloned DB.
+//
+// See TraceConfig's doc comment: setting one defers span creation until the
+// statement has finished.
+func SetTraceConfig(db *gorm.DB, conf TraceConfig) *gorm.DB {
+	return db.Set(traceConfigGormKey, conf)
+}
+
+func (conf TraceConfig) shouldTrace(duration time.Duration, hasError bool) bool {
+	if conf.AlwaysTraceErrors && hasError {
+		return true
+	}
+	if conf.SlowQueryThreshold > 0 && duration >= conf.SlowQueryThreshold {
+		return true
+	}
+	return conf.SampleRate > 0 && rand.Float64() < conf.SampleRate
+}
+
+// StatementConfig controls how the SQL statement and its bound variables
+// are rendered on the span: truncating long vars, normalizing the
+// statement, and redacting sensitive tables/columns.
+type StatementConfig struct {
+	StrLen        int
+	ByteSliceLen  int
+	Normalize     bool
+	RedactTables  []string
+	RedactColumns []string
+	SanitizeFunc  func(sql string, vars []interface{}) (string, []interface{})
+}
+
+// SqlVarsTruncationConfig controls truncation of bound SQL vars on the span.
+//
+// Deprecated: use StatementConfig, which additionally supports
+// normalization and redaction. SqlVarsTruncationConfig is kept for
+// compatibility with existing callers and is equivalent to a StatementConfig
+// with only StrLen/ByteSliceLen set.
 type SqlVarsTruncationConfig struct {
 	StrLen       int
 	ByteSliceLen int
 }
 
+// SetSqlVarsTruncationConfig sets the SqlVarsTruncationConfig used to
+// truncate SQL vars on the span, returns cloned DB.
+//
+// Deprecated: use SetStatementConfig instead.
+func SetSqlVarsTruncationConfig(db *gorm.DB, conf SqlVarsTruncationConfig) *gorm.DB {
+	return SetStatementConfig(db, StatementConfig{
+		StrLen:       conf.StrLen,
+		ByteSliceLen: conf.ByteSliceLen,
+	})
+}
+
 // SetSpanToGorm sets span to gorm settings, returns cloned DB
 func SetSpanToGorm(ctx context.Context, db *gorm.DB) *gorm.DB {
 	if ctx == nil {
@@ -36,9 +111,21 @@ func SetSpanToGorm(ctx context.Context, db *gorm.DB) *gorm.DB {
 	return db.Set(parentSpanGormKey, parentSpan)
 }
 
+// Option configures the callbacks registered by AddGormCallbacks.
+type Option func(*callbacks)
+
+// WithMetrics additionally records, for every traced statement, a latency
+// histogram, an error counter and a rows-affected histogram, each keyed by
+// {operation, table}, on reg.
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(c *callbacks) {
+		c.metrics = newMetrics(reg)
+	}
+}
+
 // AddGormCallbacks adds callbacks for tracing, you should call SetSpanToGorm to make them work
-func AddGormCallbacks(db *gorm.DB) {
-	callbacks := newCallbacks()
+func AddGormCallbacks(db *gorm.DB, opts ...Option) {
+	callbacks := newCallbacks(opts...)
 	registerCallbacks(db, "create", callbacks)
 	registerCallbacks(db, "query", callbacks)
 	registerCallbacks(db, "update", callbacks)
@@ -46,14 +133,56 @@ func AddGormCallbacks(db *gorm.DB) {
 	registerCallbacks(db, "row_query", callbacks)
 }
 
-func SetSqlVarsTruncationConfig(db *gorm.DB, conf SqlVarsTruncationConfig) *gorm.DB {
-	return db.Set(sqlVarsTruncationGormKey, conf)
+// SetStatementConfig sets the StatementConfig used to render SQL statements
+// and their bound variables, returns cloned DB.
+func SetStatementConfig(db *gorm.DB, conf StatementConfig) *gorm.DB {
+	return db.Set(statementConfigGormKey, conf)
 }
 
-type callbacks struct{}
+type callbacks struct {
+	metrics *metrics
+}
 
-func newCallbacks() *callbacks {
-	return &callbacks{}
+func newCallbacks(opts ...Option) *callbacks {
+	c := &callbacks{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type metrics struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	rows     *prometheus.HistogramVec
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "gorm_query_duration_seconds",
+			Help: "Latency of gorm SQL statements.",
+		}, []string{"operation", "table"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gorm_query_errors_total",
+			Help: "Total number of gorm SQL statements that returned an error.",
+		}, []string{"operation", "table"}),
+		rows: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "gorm_query_rows_affected",
+			Help: "Rows affected by gorm SQL statements.",
+		}, []string{"operation", "table"}),
+	}
+	reg.MustRegister(m.duration, m.errors, m.rows)
+	return m
+}
+
+func (m *metrics) observe(scope *gorm.Scope, operation string, start time.Time) {
+	table := scope.TableName()
+	m.duration.WithLabelValues(operation, table).Observe(time.Since(start).Seconds())
+	if scope.HasError() {
+		m.errors.WithLabelValues(operation, table).Inc()
+	}
+	m.rows.WithLabelValues(operation, table).Observe(float64(scope.DB().RowsAffected))
 }
 
 func (c *callbacks) beforeCreate(scope *gorm.Scope)   { c.before(scope) }
@@ -73,52 +202,82 @@ func (c *callbacks) before(scope *gorm.Scope) {
 		return
 	}
 	parentSpan := val.(opentracing.Span)
-	tr := parentSpan.Tracer()
-	sp := tr.StartSpan("sql", opentracing.ChildOf(parentSpan.Context()))
-	ext.DBType.Set(sp, "sql")
-	scope.Set(spanGormKey, sp)
+	scope.Set(startTimeGormKey, time.Now())
+	if _, ok := scope.Get(traceConfigGormKey); !ok {
+		// No TraceConfig: trace unconditionally, deferring only when asked to.
+		scope.Set(spanGormKey, startSpan(parentSpan, time.Time{}))
+	}
 }
 
 func (c *callbacks) after(scope *gorm.Scope, operation string) {
-	val, ok := scope.Get(spanGormKey)
-	if !ok {
-		return
-	}
-	sp := val.(opentracing.Span)
 	if operation == "" {
 		operation = strings.ToUpper(strings.Split(scope.SQL, " ")[0])
 	}
-	ext.Error.Set(sp, scope.HasError())
-	ext.DBStatement.Set(sp, scope.SQL)
-	if len(scope.SQLVars) > 0 {
-		var sqlVars []byte
-		val, ok = scope.Get(sqlVarsTruncationGormKey)
-		if ok {
-			conf := val.(SqlVarsTruncationConfig)
-			sqlVarsCopy := scope.SQLVars
-			for key, value := range sqlVarsCopy {
-				switch v := value.(type) {
-				case string:
-					if utf8.RuneCountInString(value.(string)) > conf.StrLen {
-						sqlVarsCopy[key] = string([]rune(value.(string))[:conf.StrLen])
-					}
-				case []byte:
-					if len(v) > conf.ByteSliceLen { // byte slice
-						sqlVarsCopy[key] = value.([]byte)[:conf.ByteSliceLen]
-					}
-				}
-			}
-			sqlVars, _ = json.Marshal(sqlVarsCopy)
-		} else {
-			sqlVars, _ = json.Marshal(scope.SQLVars)
+	hasError := scope.HasError()
+
+	var sp opentracing.Span
+	if val, ok := scope.Get(spanGormKey); ok {
+		sp = val.(opentracing.Span)
+	} else if confVal, ok := scope.Get(traceConfigGormKey); ok {
+		conf := confVal.(TraceConfig)
+		startVal, hasStart := scope.Get(startTimeGormKey)
+		if !hasStart {
+			return
 		}
+		start := startVal.(time.Time)
+		if conf.shouldTrace(time.Since(start), hasError) {
+			parentVal, _ := scope.Get(parentSpanGormKey)
+			parentSpan := parentVal.(opentracing.Span)
+			sp = startSpan(parentSpan, start)
+		}
+		if sp == nil {
+			c.observeMetrics(scope, operation, start)
+			return
+		}
+	} else {
+		return
+	}
+
+	table := scope.TableName()
+	sql, vars := scope.SQL, scope.SQLVars
+	if val, ok := scope.Get(statementConfigGormKey); ok {
+		conf := val.(StatementConfig)
+		sql, vars = sanitize.Statement(sanitize.Config(conf), table, sql, vars)
+	}
+	ext.Error.Set(sp, hasError)
+	ext.DBStatement.Set(sp, sql)
+	if len(vars) > 0 {
+		sqlVars, _ := json.Marshal(vars)
 		sp.LogFields(log.String("db.sql_vars", string(sqlVars)))
 	}
-	sp.SetTag("db.table", scope.TableName())
+	sp.SetTag("db.table", table)
 	sp.SetTag("db.method", operation)
-	sp.SetTag("db.err", scope.HasError())
+	sp.SetTag("db.err", hasError)
 	sp.SetTag("db.count", scope.DB().RowsAffected)
-	sp.Finish()
+	sp.FinishWithOptions(opentracing.FinishOptions{FinishTime: time.Now()})
+	if start, ok := scope.Get(startTimeGormKey); ok {
+		c.observeMetrics(scope, operation, start.(time.Time))
+	}
+}
+
+// startSpan starts a "sql" span as a child of parentSpan. If start is
+// non-zero, it is used as the span's start time, so that a span whose
+// creation was deferred (TraceConfig) still reports the real query duration.
+func startSpan(parentSpan opentracing.Span, start time.Time) opentracing.Span {
+	tr := parentSpan.Tracer()
+	opts := []opentracing.StartSpanOption{opentracing.ChildOf(parentSpan.Context())}
+	if !start.IsZero() {
+		opts = append(opts, opentracing.StartTime(start))
+	}
+	sp := tr.StartSpan("sql", opts...)
+	ext.DBType.Set(sp, "sql")
+	return sp
+}
+
+func (c *callbacks) observeMetrics(scope *gorm.Scope, operation string, start time.Time) {
+	if c.metrics != nil {
+		c.metrics.observe(scope, operation, start)
+	}
 }
 
 func registerCallbacks(db *gorm.DB, name string, c *callbacks) {
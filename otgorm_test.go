@@ -0,0 +1,62 @@
+package otgorm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTraceConfigShouldTrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     TraceConfig
+		duration time.Duration
+		hasError bool
+		want     bool
+	}{
+		{
+			name:     "fast query, no sampling, no error: not traced",
+			conf:     TraceConfig{SlowQueryThreshold: 50 * time.Millisecond},
+			duration: time.Millisecond,
+			want:     false,
+		},
+		{
+			name:     "duration at or above threshold is traced",
+			conf:     TraceConfig{SlowQueryThreshold: 50 * time.Millisecond},
+			duration: 50 * time.Millisecond,
+			want:     true,
+		},
+		{
+			name:     "error traced only when AlwaysTraceErrors is set",
+			conf:     TraceConfig{SlowQueryThreshold: 50 * time.Millisecond},
+			duration: time.Millisecond,
+			hasError: true,
+			want:     false,
+		},
+		{
+			name:     "AlwaysTraceErrors traces a fast, errored query",
+			conf:     TraceConfig{SlowQueryThreshold: 50 * time.Millisecond, AlwaysTraceErrors: true},
+			duration: time.Millisecond,
+			hasError: true,
+			want:     true,
+		},
+		{
+			name:     "SampleRate of 0 never traces a fast, non-erroring query",
+			conf:     TraceConfig{SampleRate: 0},
+			duration: time.Microsecond,
+			want:     false,
+		},
+		{
+			name:     "SampleRate of 1 always traces",
+			conf:     TraceConfig{SampleRate: 1},
+			duration: time.Microsecond,
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.conf.shouldTrace(tt.duration, tt.hasError); got != tt.want {
+				t.Errorf("shouldTrace(%v, %v) = %v, want %v", tt.duration, tt.hasError, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package otgormv2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+
+	"github.com/yangxikun/opentracing-gorm/internal/sanitize"
+)
+
+type ctxKey int
+
+const (
+	parentSpanCtxKey ctxKey = iota
+	startTimeCtxKey
+	traceConfigCtxKey
+)
+
+const statementConfigGormKey = "opentracingStatementConfig"
+
+// TraceConfig bounds tracing overhead on high-QPS paths by only emitting a
+// span for statements that are slow, sampled, or (optionally) errored.
+// Without a TraceConfig, every statement is traced, matching prior behavior.
+//
+// Trade-off: enabling TraceConfig defers span creation from before() to
+// after(), once the statement's duration and error are known, so the
+// span-carrying context is no longer present on the driver call for *any*
+// statement, even ones that end up traced. Driver-level instrumentation
+// (sqlcommenter, pgx tracing, dd-trace-go's SQL driver, etc.) will not see
+// the correct parent span while TraceConfig is set; that propagation, added
+// by moving span start into before(), is what you give up in exchange for
+// bounding overhead.
+type TraceConfig struct {
+	// SlowQueryThreshold, if positive, always traces statements that take at
+	// least this long.
+	SlowQueryThreshold time.Duration
+	// SampleRate, in [0, 1], is the fraction of statements traced regardless
+	// of duration.
+	SampleRate float64
+	// AlwaysTraceErrors always traces statements that returned an error.
+	AlwaysTraceErrors bool
+}
+
+// SetTraceConfig sets the TraceConfig used to decide whether to emit a span
+// for a statement, returns cloned DB.
+//
+// See TraceConfig's doc comment: setting one trades away before-the-driver-
+// call span propagation for bounded tracing overhead.
+func SetTraceConfig(db *gorm.DB, conf TraceConfig) *gorm.DB {
+	return db.WithContext(context.WithValue(db.Statement.Context, traceConfigCtxKey, conf))
+}
+
+func (conf TraceConfig) shouldTrace(duration time.Duration, hasError bool) bool {
+	if conf.AlwaysTraceErrors && hasError {
+		return true
+	}
+	if conf.SlowQueryThreshold > 0 && duration >= conf.SlowQueryThreshold {
+		return true
+	}
+	return conf.SampleRate > 0 && rand.Float64() < conf.SampleRate
+}
+
+// StatementConfig controls how the SQL statement and its bound variables
+// are rendered on the span: truncating long vars, normalizing the
+// statement, and redacting sensitive tables/columns.
+type StatementConfig struct {
+	StrLen        int
+	ByteSliceLen  int
+	Normalize     bool
+	RedactTables  []string
+	RedactColumns []string
+	SanitizeFunc  func(sql string, vars []interface{}) (string, []interface{})
+}
+
+// SqlVarsTruncationConfig controls truncation of bound SQL vars on the span.
+//
+// Deprecated: use StatementConfig, which additionally supports
+// normalization and redaction. SqlVarsTruncationConfig is kept for
+// compatibility with existing callers and is equivalent to a StatementConfig
+// with only StrLen/ByteSliceLen set.
+type SqlVarsTruncationConfig struct {
+	StrLen       int
+	ByteSliceLen int
+}
+
+// SetSqlVarsTruncationConfig sets the SqlVarsTruncationConfig used to
+// truncate SQL vars on the span, returns cloned DB.
+//
+// Deprecated: use SetStatementConfig instead.
+func SetSqlVarsTruncationConfig(db *gorm.DB, conf SqlVarsTruncationConfig) *gorm.DB {
+	return SetStatementConfig(db, StatementConfig{
+		StrLen:       conf.StrLen,
+		ByteSliceLen: conf.ByteSliceLen,
+	})
+}
+
+// SetSpanToGorm sets span to gorm settings, returns cloned DB.
+// gorm v2 has no Scope.Set, so the parent span is carried on the
+// session context instead and picked up by the before callbacks.
+func SetSpanToGorm(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if ctx == nil {
+		return db
+	}
+	parentSpan := opentracing.SpanFromContext(ctx)
+	if parentSpan == nil {
+		return db
+	}
+	return db.WithContext(context.WithValue(ctx, parentSpanCtxKey, parentSpan))
+}
+
+// Option configures the callbacks registered by AddGormCallbacks.
+type Option func(*callbacks)
+
+// WithMetrics additionally records, for every traced statement, a latency
+// histogram, an error counter and a rows-affected histogram, each keyed by
+// {operation, table}, on reg.
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(c *callbacks) {
+		c.metrics = newMetrics(reg)
+	}
+}
+
+// AddGormCallbacks adds callbacks for tracing, you should call SetSpanToGorm to make them work
+func AddGormCallbacks(db *gorm.DB, opts ...Option) {
+	callbacks := newCallbacks(opts...)
+	registerCallbacks(db, "create", callbacks)
+	registerCallbacks(db, "query", callbacks)
+	registerCallbacks(db, "update", callbacks)
+	registerCallbacks(db, "delete", callbacks)
+	registerCallbacks(db, "row", callbacks)
+	registerCallbacks(db, "raw", callbacks)
+}
+
+// SetStatementConfig sets the StatementConfig used to render SQL statements
+// and their bound variables, returns cloned DB.
+func SetStatementConfig(db *gorm.DB, conf StatementConfig) *gorm.DB {
+	return db.Set(statementConfigGormKey, conf)
+}
+
+type callbacks struct {
+	metrics *metrics
+}
+
+func newCallbacks(opts ...Option) *callbacks {
+	c := &callbacks{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type metrics struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	rows     *prometheus.HistogramVec
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "gormv2_query_duration_seconds",
+			Help: "Latency of gorm SQL statements.",
+		}, []string{"operation", "table"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gormv2_query_errors_total",
+			Help: "Total number of gorm SQL statements that returned an error.",
+		}, []string{"operation", "table"}),
+		rows: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "gormv2_query_rows_affected",
+			Help: "Rows affected by gorm SQL statements.",
+		}, []string{"operation", "table"}),
+	}
+	reg.MustRegister(m.duration, m.errors, m.rows)
+	return m
+}
+
+func (m *metrics) observe(db *gorm.DB, operation string, start time.Time) {
+	table := db.Statement.Table
+	m.duration.WithLabelValues(operation, table).Observe(time.Since(start).Seconds())
+	if db.Error != nil {
+		m.errors.WithLabelValues(operation, table).Inc()
+	}
+	m.rows.WithLabelValues(operation, table).Observe(float64(db.RowsAffected))
+}
+
+func (c *callbacks) beforeCreate(db *gorm.DB) { c.before(db) }
+func (c *callbacks) afterCreate(db *gorm.DB)  { c.after(db, "INSERT") }
+func (c *callbacks) beforeQuery(db *gorm.DB)  { c.before(db) }
+func (c *callbacks) afterQuery(db *gorm.DB)   { c.after(db, "SELECT") }
+func (c *callbacks) beforeUpdate(db *gorm.DB) { c.before(db) }
+func (c *callbacks) afterUpdate(db *gorm.DB)  { c.after(db, "UPDATE") }
+func (c *callbacks) beforeDelete(db *gorm.DB) { c.before(db) }
+func (c *callbacks) afterDelete(db *gorm.DB)  { c.after(db, "DELETE") }
+func (c *callbacks) beforeRow(db *gorm.DB)    { c.before(db) }
+func (c *callbacks) afterRow(db *gorm.DB)     { c.after(db, "") }
+func (c *callbacks) beforeRaw(db *gorm.DB)    { c.before(db) }
+func (c *callbacks) afterRaw(db *gorm.DB)     { c.after(db, "") }
+
+func (c *callbacks) before(db *gorm.DB) {
+	if db.DryRun {
+		// DryRun statements are used by gorm itself to compose subqueries and
+		// never reach the driver, so tracing them would just add noise.
+		return
+	}
+	val := db.Statement.Context.Value(parentSpanCtxKey)
+	if val == nil {
+		return
+	}
+	db.Statement.Context = context.WithValue(db.Statement.Context, startTimeCtxKey, time.Now())
+	if _, ok := db.Statement.Context.Value(traceConfigCtxKey).(TraceConfig); !ok {
+		// No TraceConfig: trace unconditionally, deferring only when asked to.
+		parentSpan := val.(opentracing.Span)
+		db.Statement.Context = opentracing.ContextWithSpan(db.Statement.Context, startSpan(parentSpan, time.Time{}))
+	}
+}
+
+func (c *callbacks) after(db *gorm.DB, operation string) {
+	if db.DryRun {
+		// Mirror the before() guard: gorm reuses the session context for
+		// DryRun subqueries built off an already-traced db, so without this
+		// check we'd pick up the outer span from db.Statement.Context and
+		// finish it here instead of skipping the subquery entirely.
+		return
+	}
+	if operation == "" {
+		sql := db.Statement.SQL.String()
+		operation = strings.ToUpper(strings.Split(sql, " ")[0])
+	}
+	hasError := db.Error != nil
+
+	parentSpan, _ := db.Statement.Context.Value(parentSpanCtxKey).(opentracing.Span)
+	if parentSpan == nil {
+		return
+	}
+	// The context SetSpanToGorm stored also carries the parent span itself;
+	// only a span started by before() is finished here.
+	sp := opentracing.SpanFromContext(db.Statement.Context)
+	if sp == parentSpan {
+		sp = nil
+	}
+	if sp == nil {
+		conf, ok := db.Statement.Context.Value(traceConfigCtxKey).(TraceConfig)
+		if !ok {
+			return
+		}
+		start, ok := db.Statement.Context.Value(startTimeCtxKey).(time.Time)
+		if !ok {
+			return
+		}
+		if conf.shouldTrace(time.Since(start), hasError) {
+			sp = startSpan(parentSpan, start)
+		} else {
+			c.observeMetrics(db, operation, start)
+			return
+		}
+	}
+
+	sql, vars := db.Statement.SQL.String(), db.Statement.Vars
+	if val, ok := db.Get(statementConfigGormKey); ok {
+		conf := val.(StatementConfig)
+		sql, vars = sanitize.Statement(sanitize.Config(conf), db.Statement.Table, sql, vars)
+	}
+	ext.Error.Set(sp, hasError)
+	ext.DBStatement.Set(sp, sql)
+	if len(vars) > 0 {
+		sqlVars, _ := json.Marshal(vars)
+		sp.LogFields(log.String("db.sql_vars", string(sqlVars)))
+	}
+	sp.SetTag("db.table", db.Statement.Table)
+	sp.SetTag("db.method", operation)
+	sp.SetTag("db.err", hasError)
+	sp.SetTag("db.count", db.RowsAffected)
+	sp.FinishWithOptions(opentracing.FinishOptions{FinishTime: time.Now()})
+	if start, ok := db.Statement.Context.Value(startTimeCtxKey).(time.Time); ok {
+		c.observeMetrics(db, operation, start)
+	}
+}
+
+// startSpan starts a "sql" span as a child of parentSpan. If start is
+// non-zero, it is used as the span's start time, so that a span whose
+// creation was deferred (TraceConfig) still reports the real query duration.
+func startSpan(parentSpan opentracing.Span, start time.Time) opentracing.Span {
+	tr := parentSpan.Tracer()
+	opts := []opentracing.StartSpanOption{opentracing.ChildOf(parentSpan.Context())}
+	if !start.IsZero() {
+		opts = append(opts, opentracing.StartTime(start))
+	}
+	sp := tr.StartSpan("sql", opts...)
+	ext.DBType.Set(sp, "sql")
+	return sp
+}
+
+func (c *callbacks) observeMetrics(db *gorm.DB, operation string, start time.Time) {
+	if c.metrics != nil {
+		c.metrics.observe(db, operation, start)
+	}
+}
+
+func registerCallbacks(db *gorm.DB, name string, c *callbacks) {
+	beforeName := fmt.Sprintf("tracing:%v_before", name)
+	afterName := fmt.Sprintf("tracing:%v_after", name)
+	gormCallbackName := fmt.Sprintf("gorm:%v", name)
+	// gorm does some magic, if you pass CallbackProcessor here - nothing works
+	switch name {
+	case "create":
+		db.Callback().Create().Before(gormCallbackName).Register(beforeName, c.beforeCreate)
+		db.Callback().Create().After(gormCallbackName).Register(afterName, c.afterCreate)
+	case "query":
+		db.Callback().Query().Before(gormCallbackName).Register(beforeName, c.beforeQuery)
+		db.Callback().Query().After(gormCallbackName).Register(afterName, c.afterQuery)
+	case "update":
+		db.Callback().Update().Before(gormCallbackName).Register(beforeName, c.beforeUpdate)
+		db.Callback().Update().After(gormCallbackName).Register(afterName, c.afterUpdate)
+	case "delete":
+		db.Callback().Delete().Before(gormCallbackName).Register(beforeName, c.beforeDelete)
+		db.Callback().Delete().After(gormCallbackName).Register(afterName, c.afterDelete)
+	case "row":
+		db.Callback().Row().Before(gormCallbackName).Register(beforeName, c.beforeRow)
+		db.Callback().Row().After(gormCallbackName).Register(afterName, c.afterRow)
+	case "raw":
+		db.Callback().Raw().Before(gormCallbackName).Register(beforeName, c.beforeRaw)
+		db.Callback().Raw().After(gormCallbackName).Register(afterName, c.afterRaw)
+	}
+}
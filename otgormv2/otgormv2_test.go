@@ -0,0 +1,147 @@
+package otgormv2
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	jinzhugorm "github.com/jinzhu/gorm"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gorm.io/gorm"
+	gormtests "gorm.io/gorm/utils/tests"
+
+	otgorm "github.com/yangxikun/opentracing-gorm"
+)
+
+// dummySQLCommon satisfies jinzhu/gorm's SQLCommon interface without ever
+// dialing a real database, which is all AddGormCallbacks needs: it only
+// registers callbacks, it never executes a query.
+type dummySQLCommon struct{}
+
+func (dummySQLCommon) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return nil, nil
+}
+func (dummySQLCommon) Prepare(query string) (*sql.Stmt, error) { return nil, nil }
+func (dummySQLCommon) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, nil
+}
+func (dummySQLCommon) QueryRow(query string, args ...interface{}) *sql.Row { return nil }
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(gormtests.DummyDialector{}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+	return db
+}
+
+// TestDryRunSubqueryDoesNotFinishOuterSpan reproduces gorm's own pattern for
+// composing subqueries: v.Session(&gorm.Session{DryRun: true}).getInstance(),
+// which does not clone the Statement/Context when only DryRun is set. If v
+// is a db mid-flight through an already-started span (the normal case, since
+// gorm builds subqueries off the very db whose query is being built), the
+// dry-run subquery must not finish or tag that outer span.
+func TestDryRunSubqueryDoesNotFinishOuterSpan(t *testing.T) {
+	db := openTestDB(t)
+	AddGormCallbacks(db)
+
+	tracer := mocktracer.New()
+	parentSpan := tracer.StartSpan("handler")
+	ctx := opentracing.ContextWithSpan(context.Background(), parentSpan)
+	db = SetSpanToGorm(ctx, db)
+
+	outer := db.Session(&gorm.Session{NewDB: true}).Model(&gormtests.User{})
+	c := newCallbacks()
+	c.before(outer) // as gorm would, before building the outer query's clauses
+
+	// gorm composes a subquery by reusing outer's Statement/Context verbatim.
+	var users []gormtests.User
+	if err := outer.Session(&gorm.Session{DryRun: true}).Find(&users).Error; err != nil {
+		t.Fatalf("dry-run Find: %v", err)
+	}
+
+	if len(tracer.FinishedSpans()) != 0 {
+		t.Fatalf("dry-run subquery finished the outer span: %+v", tracer.FinishedSpans())
+	}
+
+	c.after(outer, "SELECT")
+	if finished := tracer.FinishedSpans(); len(finished) != 1 {
+		t.Fatalf("expected exactly 1 finished span, got %d", len(finished))
+	}
+}
+
+// TestTraceConfigSkipsFastUntracedQueries exercises the deferred-span path:
+// with a TraceConfig set, before() records a start time but starts no span
+// (the test puts that start time in the context directly), and after()
+// decides whether to start (and backdate) a span once the duration and
+// error are known.
+func TestTraceConfigSkipsFastUntracedQueries(t *testing.T) {
+	tracer := mocktracer.New()
+	parentSpan := tracer.StartSpan("handler")
+	defer parentSpan.Finish()
+
+	newDB := func(conf TraceConfig) *gorm.DB {
+		ctx := context.WithValue(context.Background(), parentSpanCtxKey, parentSpan)
+		ctx = context.WithValue(ctx, traceConfigCtxKey, conf)
+		ctx = context.WithValue(ctx, startTimeCtxKey, time.Now().Add(-time.Second))
+		return &gorm.DB{Config: &gorm.Config{}, Statement: &gorm.Statement{Context: ctx, Table: "users"}}
+	}
+
+	c := newCallbacks()
+
+	// Below the threshold, not sampled, no error: no span is started.
+	c.after(newDB(TraceConfig{SlowQueryThreshold: 2 * time.Second}), "SELECT")
+	if got := len(tracer.FinishedSpans()); got != 0 {
+		t.Fatalf("expected no span for a fast, unsampled, non-erroring query, got %d", got)
+	}
+
+	// At/above the threshold: a span is started (backdated) and finished.
+	c.after(newDB(TraceConfig{SlowQueryThreshold: 500 * time.Millisecond}), "SELECT")
+	if got := len(tracer.FinishedSpans()); got != 1 {
+		t.Fatalf("expected 1 span for a slow query, got %d", got)
+	}
+
+	// SampleRate of 1 always traces, even a fast query.
+	c.after(newDB(TraceConfig{SampleRate: 1}), "SELECT")
+	if got := len(tracer.FinishedSpans()); got != 2 {
+		t.Fatalf("expected 2 spans after a fully-sampled fast query, got %d", got)
+	}
+}
+
+func TestMetricsObserve(t *testing.T) {
+	m := newMetrics(prometheus.NewRegistry())
+
+	db := &gorm.DB{Statement: &gorm.Statement{Table: "users"}, RowsAffected: 3}
+	m.observe(db, "SELECT", time.Now().Add(-time.Millisecond))
+	if got := testutil.ToFloat64(m.errors.WithLabelValues("SELECT", "users")); got != 0 {
+		t.Fatalf("expected 0 errors observed, got %v", got)
+	}
+
+	db.Error = gorm.ErrRecordNotFound
+	m.observe(db, "SELECT", time.Now())
+	if got := testutil.ToFloat64(m.errors.WithLabelValues("SELECT", "users")); got != 1 {
+		t.Fatalf("expected 1 error observed after db.Error set, got %v", got)
+	}
+}
+
+// TestMetricsSharedRegistryWithV1 reproduces the v1/v2 migration scenario:
+// a service enabling otgorm.WithMetrics for its jinzhu/gorm connections and
+// otgormv2.WithMetrics for its gorm.io/gorm connections against the same
+// Registerer must not panic on duplicate metric name registration.
+func TestMetricsSharedRegistryWithV1(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	v1db, err := jinzhugorm.Open("common", dummySQLCommon{})
+	if err != nil {
+		t.Fatalf("jinzhugorm.Open: %v", err)
+	}
+	otgorm.AddGormCallbacks(v1db, otgorm.WithMetrics(reg))
+
+	v2db := openTestDB(t)
+	AddGormCallbacks(v2db, WithMetrics(reg))
+}
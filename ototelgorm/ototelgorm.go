@@ -0,0 +1,285 @@
+package ototelgorm
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+
+	"github.com/yangxikun/opentracing-gorm/internal/sanitize"
+	"github.com/yangxikun/opentracing-gorm/otgormv2"
+)
+
+const (
+	tracerName = "github.com/yangxikun/opentracing-gorm/ototelgorm"
+	meterName  = "github.com/yangxikun/opentracing-gorm/ototelgorm"
+)
+
+var dbRowsAffectedKey = attribute.Key("db.rows_affected")
+
+type ctxKey int
+
+const startTimeCtxKey ctxKey = iota
+
+// Option configures the callbacks registered by AddGormCallbacks.
+type Option func(*callbacks)
+
+// WithTracerProvider sets the trace.TracerProvider used to create spans,
+// the global TracerProvider is used by default.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *callbacks) {
+		c.tracer = provider.Tracer(tracerName)
+	}
+}
+
+// WithAttributes adds extra attributes to every span, e.g. deployment or service attributes.
+func WithAttributes(attrs ...attribute.KeyValue) Option {
+	return func(c *callbacks) {
+		c.attrs = append(c.attrs, attrs...)
+	}
+}
+
+// WithDBName sets the db.name attribute on every span.
+func WithDBName(name string) Option {
+	return func(c *callbacks) {
+		c.attrs = append(c.attrs, semconv.DBNameKey.String(name))
+	}
+}
+
+// WithoutQueryVariables excludes bound variables from the db.statement attribute,
+// only the parameterized SQL is recorded.
+func WithoutQueryVariables() Option {
+	return func(c *callbacks) {
+		c.excludeQueryVars = true
+	}
+}
+
+// WithQueryFormatter formats the SQL statement before it is set as the db.statement attribute.
+func WithQueryFormatter(formatter func(sql string) string) Option {
+	return func(c *callbacks) {
+		c.queryFormatter = formatter
+	}
+}
+
+// WithStatementConfig truncates/normalizes/redacts the SQL statement and its
+// bound variables before they are rendered into the db.statement attribute,
+// sharing the same StatementConfig as otgormv2.
+func WithStatementConfig(conf otgormv2.StatementConfig) Option {
+	return func(c *callbacks) {
+		c.statementConf = &conf
+	}
+}
+
+// WithMeterProvider sets the metric.MeterProvider used to record metrics,
+// the global MeterProvider is used by default.
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(c *callbacks) {
+		c.meterProvider = provider
+	}
+}
+
+// WithoutMetrics disables the latency/error/rows-affected metrics that are
+// otherwise recorded alongside tracing by default.
+func WithoutMetrics() Option {
+	return func(c *callbacks) {
+		c.metricsDisabled = true
+	}
+}
+
+// AddGormCallbacks adds callbacks for tracing with OpenTelemetry.
+func AddGormCallbacks(db *gorm.DB, opts ...Option) {
+	c := &callbacks{
+		tracer:        otel.GetTracerProvider().Tracer(tracerName),
+		meterProvider: otel.GetMeterProvider(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if !c.metricsDisabled {
+		c.metrics = newMetrics(c.meterProvider.Meter(meterName))
+	}
+	registerCallbacks(db, "create", c)
+	registerCallbacks(db, "query", c)
+	registerCallbacks(db, "update", c)
+	registerCallbacks(db, "delete", c)
+	registerCallbacks(db, "row", c)
+	registerCallbacks(db, "raw", c)
+}
+
+type callbacks struct {
+	tracer           trace.Tracer
+	attrs            []attribute.KeyValue
+	excludeQueryVars bool
+	queryFormatter   func(sql string) string
+	statementConf    *otgormv2.StatementConfig
+	meterProvider    metric.MeterProvider
+	metricsDisabled  bool
+	metrics          *metrics
+}
+
+type metrics struct {
+	duration metric.Float64Histogram
+	errors   metric.Int64Counter
+	rows     metric.Int64Histogram
+}
+
+func newMetrics(meter metric.Meter) *metrics {
+	duration, _ := meter.Float64Histogram("gorm.query.duration",
+		metric.WithDescription("Latency of gorm SQL statements."),
+		metric.WithUnit("s"))
+	errors, _ := meter.Int64Counter("gorm.query.errors",
+		metric.WithDescription("Total number of gorm SQL statements that returned an error."))
+	rows, _ := meter.Int64Histogram("gorm.query.rows_affected",
+		metric.WithDescription("Rows affected by gorm SQL statements."))
+	return &metrics{duration: duration, errors: errors, rows: rows}
+}
+
+func (m *metrics) observe(ctx context.Context, db *gorm.DB, operation string, start time.Time) {
+	attrs := metric.WithAttributes(
+		semconv.DBOperationKey.String(operation),
+		semconv.DBSQLTableKey.String(db.Statement.Table),
+	)
+	m.duration.Record(ctx, time.Since(start).Seconds(), attrs)
+	if db.Error != nil {
+		m.errors.Add(ctx, 1, attrs)
+	}
+	m.rows.Record(ctx, db.RowsAffected, attrs)
+}
+
+func (c *callbacks) beforeCreate(db *gorm.DB) { c.before(db) }
+func (c *callbacks) afterCreate(db *gorm.DB)  { c.after(db, "INSERT") }
+func (c *callbacks) beforeQuery(db *gorm.DB)  { c.before(db) }
+func (c *callbacks) afterQuery(db *gorm.DB)   { c.after(db, "SELECT") }
+func (c *callbacks) beforeUpdate(db *gorm.DB) { c.before(db) }
+func (c *callbacks) afterUpdate(db *gorm.DB)  { c.after(db, "UPDATE") }
+func (c *callbacks) beforeDelete(db *gorm.DB) { c.before(db) }
+func (c *callbacks) afterDelete(db *gorm.DB)  { c.after(db, "DELETE") }
+func (c *callbacks) beforeRow(db *gorm.DB)    { c.before(db) }
+func (c *callbacks) afterRow(db *gorm.DB)     { c.after(db, "") }
+func (c *callbacks) beforeRaw(db *gorm.DB)    { c.before(db) }
+func (c *callbacks) afterRaw(db *gorm.DB)     { c.after(db, "") }
+
+func (c *callbacks) before(db *gorm.DB) {
+	if db.DryRun {
+		return
+	}
+	db.Statement.Context, _ = c.tracer.Start(db.Statement.Context, "gorm.sql", trace.WithSpanKind(trace.SpanKindClient))
+	if c.metrics != nil {
+		db.Statement.Context = context.WithValue(db.Statement.Context, startTimeCtxKey, time.Now())
+	}
+}
+
+func (c *callbacks) after(db *gorm.DB, operation string) {
+	if db.DryRun {
+		// Mirror the before() guard: gorm reuses the session context for
+		// DryRun subqueries built off an already-traced db, so without this
+		// check we'd pick up the outer span from db.Statement.Context and
+		// end it here instead of skipping the subquery entirely.
+		return
+	}
+	span := trace.SpanFromContext(db.Statement.Context)
+	if !span.IsRecording() {
+		return
+	}
+	defer span.End()
+
+	sql := db.Statement.SQL.String()
+	if operation == "" {
+		operation = strings.ToUpper(strings.Split(sql, " ")[0])
+	}
+
+	attrs := make([]attribute.KeyValue, 0, len(c.attrs)+5)
+	attrs = append(attrs, c.attrs...)
+	attrs = append(attrs, semconv.DBSystemKey.String(dbSystem(db)))
+	attrs = append(attrs, semconv.DBOperationKey.String(operation))
+	if db.Statement.Table != "" {
+		attrs = append(attrs, semconv.DBSQLTableKey.String(db.Statement.Table))
+	}
+	attrs = append(attrs, dbRowsAffectedKey.Int64(db.RowsAffected))
+	attrs = append(attrs, semconv.DBStatementKey.String(c.formatQuery(db, sql, db.Statement.Vars)))
+
+	span.SetAttributes(attrs...)
+	if db.Error != nil {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+	}
+
+	if c.metrics != nil {
+		if start, ok := db.Statement.Context.Value(startTimeCtxKey).(time.Time); ok {
+			c.metrics.observe(db.Statement.Context, db, operation, start)
+		}
+	}
+}
+
+func (c *callbacks) formatQuery(db *gorm.DB, sql string, vars []interface{}) string {
+	var normalize bool
+	if c.statementConf != nil {
+		conf := *c.statementConf
+		// Explain fills "?" placeholders positionally, so normalizing sql
+		// here (which inserts extra "?"s for literals) would shift bound
+		// vars into the wrong slots. Sanitize vars now, normalize the
+		// explained/raw output below instead. SanitizeFunc, when set, takes
+		// over from Normalize as it does in sanitize.Statement.
+		normalize, conf.Normalize = conf.Normalize && conf.SanitizeFunc == nil, false
+		sql, vars = sanitize.Statement(sanitize.Config(conf), db.Statement.Table, sql, vars)
+	}
+
+	query := sql
+	if !c.excludeQueryVars {
+		query = db.Dialector.Explain(sql, vars...)
+	}
+	if normalize {
+		query = sanitize.Normalize(query)
+	}
+	if c.queryFormatter != nil {
+		query = c.queryFormatter(query)
+	}
+	return query
+}
+
+func dbSystem(db *gorm.DB) string {
+	switch db.Dialector.Name() {
+	case "mysql":
+		return "mysql"
+	case "postgres":
+		return "postgresql"
+	case "sqlite":
+		return "sqlite"
+	case "sqlserver":
+		return "mssql"
+	case "clickhouse":
+		return "clickhouse"
+	default:
+		return "other_sql"
+	}
+}
+
+func registerCallbacks(db *gorm.DB, name string, c *callbacks) {
+	switch name {
+	case "create":
+		db.Callback().Create().Before("gorm:create").Register("otel:before_create", c.beforeCreate)
+		db.Callback().Create().After("gorm:create").Register("otel:after_create", c.afterCreate)
+	case "query":
+		db.Callback().Query().Before("gorm:query").Register("otel:before_query", c.beforeQuery)
+		db.Callback().Query().After("gorm:query").Register("otel:after_query", c.afterQuery)
+	case "update":
+		db.Callback().Update().Before("gorm:update").Register("otel:before_update", c.beforeUpdate)
+		db.Callback().Update().After("gorm:update").Register("otel:after_update", c.afterUpdate)
+	case "delete":
+		db.Callback().Delete().Before("gorm:delete").Register("otel:before_delete", c.beforeDelete)
+		db.Callback().Delete().After("gorm:delete").Register("otel:after_delete", c.afterDelete)
+	case "row":
+		db.Callback().Row().Before("gorm:row").Register("otel:before_row", c.beforeRow)
+		db.Callback().Row().After("gorm:row").Register("otel:after_row", c.afterRow)
+	case "raw":
+		db.Callback().Raw().Before("gorm:raw").Register("otel:before_raw", c.beforeRaw)
+		db.Callback().Raw().After("gorm:raw").Register("otel:after_raw", c.afterRaw)
+	}
+}
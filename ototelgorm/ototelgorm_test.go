@@ -0,0 +1,76 @@
+package ototelgorm
+
+import (
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gorm.io/gorm"
+	gormtests "gorm.io/gorm/utils/tests"
+
+	"github.com/yangxikun/opentracing-gorm/otgormv2"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(gormtests.DummyDialector{}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+	return db
+}
+
+// TestDryRunSubqueryDoesNotFinishOuterSpan mirrors otgormv2's test of the
+// same name: gorm reuses the outer db's Statement/Context verbatim when
+// composing a DryRun subquery, so before()/after() must recognize DryRun and
+// skip it entirely rather than ending the outer span early.
+func TestDryRunSubqueryDoesNotFinishOuterSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	db := openTestDB(t)
+	AddGormCallbacks(db, WithTracerProvider(tp), WithoutMetrics())
+
+	c := &callbacks{tracer: tp.Tracer(tracerName)}
+	outer := db.Session(&gorm.Session{NewDB: true}).Model(&gormtests.User{})
+	c.before(outer) // as gorm would, before building the outer query's clauses
+
+	// gorm composes a subquery by reusing outer's Statement/Context verbatim.
+	var users []gormtests.User
+	if err := outer.Session(&gorm.Session{DryRun: true}).Find(&users).Error; err != nil {
+		t.Fatalf("dry-run Find: %v", err)
+	}
+
+	if got := recorder.Ended(); len(got) != 0 {
+		t.Fatalf("dry-run subquery finished the outer span: %+v", got)
+	}
+
+	c.after(outer, "SELECT")
+	if got := recorder.Ended(); len(got) != 1 {
+		t.Fatalf("expected exactly 1 finished span, got %d", len(got))
+	}
+}
+
+// TestFormatQueryNormalizeKeepsVarsAligned reproduces the bug where
+// normalizing sql before Explain inserts extra "?" placeholders for the
+// literals it replaces, shifting every bound var that follows them into the
+// wrong slot. Normalize must only ever be applied to Explain's output, never
+// fed into Explain as input.
+func TestFormatQueryNormalizeKeepsVarsAligned(t *testing.T) {
+	db := openTestDB(t)
+	c := &callbacks{
+		statementConf: &otgormv2.StatementConfig{Normalize: true},
+	}
+
+	sql := "SELECT * FROM orders WHERE total > 100 AND user_id = ?"
+	vars := []interface{}{"alice-secret-id"}
+
+	got := c.formatQuery(db, sql, vars)
+	if !strings.Contains(got, `user_id = "alice-secret-id"`) {
+		t.Fatalf("expected the real bound value attributed to user_id, got %q", got)
+	}
+	if !strings.Contains(got, "total > ?") {
+		t.Fatalf("expected the literal 100 to be normalized to ? instead of receiving the bound value, got %q", got)
+	}
+}